@@ -20,15 +20,28 @@ under the License.
 package validator
 
 import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
 	"crypto/ecdsa"
+	"crypto/rand"
 	"crypto/x509"
+	"encoding/asn1"
 	"errors"
+	"fmt"
 	"github.com/golang/protobuf/proto"
 	"github.com/op/go-logging"
 	_ "github.com/openblockchain/obc-peer/openchain"
 	"github.com/openblockchain/obc-peer/openchain/crypto/peer"
+	"github.com/openblockchain/obc-peer/openchain/crypto/primitives"
 	"github.com/openblockchain/obc-peer/openchain/crypto/utils"
 	obc "github.com/openblockchain/obc-peer/protos"
+	"github.com/spf13/viper"
+	"golang.org/x/crypto/chacha20poly1305"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
 )
 
 // Errors
@@ -43,6 +56,15 @@ var (
 	ErrTransactionSignature                  error = errors.New("Missing Transaction Signature.")
 	ErrInvalidEncryptedPayloadNilOrEmpty     error = errors.New("Invalid encrypted payload. Nil or empty")
 	ErrInvalidEncryptedChaincodeIDNilOrEmpty error = errors.New("Invalid encrypted chaincodeId. Nil or empty")
+	ErrUntrustedTransactionCert              error = errors.New("Untrusted Transaction Certificate.")
+
+	ErrAttributeNotFound     error = errors.New("Attribute not found in transaction certificate.")
+	ErrInvalidAttributeValue error = errors.New("Invalid attribute value.")
+
+	ErrConfidentialityKeyMissing   error = errors.New("Validator does not hold the enrollment chain key for this confidentiality group.")
+	ErrConfidentialPayloadTampered error = errors.New("Confidential payload failed decryption.")
+
+	ErrUnknownEncryptionScheme = errors.New("Unknown encryption scheme.")
 
 	ErrEncrypt = errors.New("secret: encryption failed")
 	ErrDecrypt = errors.New("secret: decryption failed")
@@ -50,6 +72,17 @@ var (
 
 var ErrInvalidSignature error = errors.New("Invalid Signature.")
 
+// TCert critical extension OIDs.
+var (
+	// tCertAttributesHeaders carries the comma-separated "name->position"
+	// header describing where each attribute's value extension lives.
+	tCertAttributesHeaders = asn1.ObjectIdentifier{1, 2, 3, 4, 5, 6, 7, 8, 1}
+
+	// tCertAttributeBase is the OID prefix under which the per-attribute
+	// value extensions are stored, one per declared position.
+	tCertAttributeBase = asn1.ObjectIdentifier{1, 2, 3, 4, 5, 6, 7, 8, 2}
+)
+
 // Log
 
 var log = logging.MustGetLogger("CRYPTO.VALIDATOR")
@@ -63,8 +96,24 @@ type Validator struct {
 
 	rootsCertPool *x509.CertPool
 
+	// Trust anchors, built by Register from ecaCertsChain/tcaCertsChain
+	// below once those are retrieved.
+	ecaCertPool *x509.CertPool
+	tcaCertPool *x509.CertPool
+
+	// Root certificate chains (DER-encoded), populated by
+	// retrieveECACertsChain/retrieveTCACertsChain.
+	ecaCertsChain [][]byte
+	tcaCertsChain [][]byte
+
 	enrollCerts map[string]*x509.Certificate
 
+	// certByDERHash caches certificates parsed by cachedCertFromDER,
+	// keyed by the SHA3-384 hash of their DER bytes. Distinct from
+	// enrollCerts, which getEnrollmentCert/Verify key by enrollment ID.
+	certByDERHash     map[string]*x509.Certificate
+	certByDERHashLock sync.RWMutex
+
 	// 48-bytes identifier
 	id []byte
 
@@ -75,6 +124,12 @@ type Validator struct {
 
 	// Enrollment Chain
 	enrollChainKey []byte
+
+	// strictConfidentiality governs how TransactionPreValidation reacts to
+	// a confidential tx this validator cannot decrypt: when true, missing
+	// the confidentiality group's key fails the tx; when false, the tx is
+	// let through unexamined so it can still be forwarded.
+	strictConfidentiality bool
 }
 
 type EncryptionScheme interface {
@@ -83,6 +138,229 @@ type EncryptionScheme interface {
 	Decrypt(ct []byte) ([]byte, error)
 }
 
+// encryptionSchemeFactory builds an EncryptionScheme bound to key.
+type encryptionSchemeFactory func(key []byte) (EncryptionScheme, error)
+
+var (
+	encryptionSchemesLock sync.RWMutex
+	encryptionSchemes     = make(map[string]encryptionSchemeFactory)
+)
+
+// RegisterEncryptionScheme makes an EncryptionScheme factory available
+// under name for later lookup by TransactionPreExecution. Registering
+// under a name that is already taken overwrites the previous factory, so
+// future schemes (post-quantum KEM wrappers, for example) can be added,
+// or existing ones swapped, without touching the validator core.
+func RegisterEncryptionScheme(name string, factory encryptionSchemeFactory) {
+	encryptionSchemesLock.Lock()
+	defer encryptionSchemesLock.Unlock()
+
+	encryptionSchemes[name] = factory
+}
+
+// newEncryptionScheme looks up the factory registered under name and uses
+// it to build an EncryptionScheme bound to key.
+func newEncryptionScheme(name string, key []byte) (EncryptionScheme, error) {
+	encryptionSchemesLock.RLock()
+	factory, ok := encryptionSchemes[name]
+	encryptionSchemesLock.RUnlock()
+
+	if !ok {
+		return nil, ErrUnknownEncryptionScheme
+	}
+
+	return factory(key)
+}
+
+func init() {
+	RegisterEncryptionScheme("aes-gcm-256", newAESGCM256EncryptionScheme)
+	RegisterEncryptionScheme("chacha20poly1305", newChaCha20Poly1305EncryptionScheme)
+}
+
+// aeadEncryptionScheme adapts a cipher.AEAD to the EncryptionScheme
+// interface. Encrypt prepends a random 96-bit nonce to the ciphertext;
+// Decrypt rejects ciphertexts shorter than nonce+tag.
+type aeadEncryptionScheme struct {
+	aead cipher.AEAD
+}
+
+func (s *aeadEncryptionScheme) Encrypt(msg []byte) ([]byte, error) {
+	nonce := make([]byte, s.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	return s.aead.Seal(nonce, nonce, msg, nil), nil
+}
+
+func (s *aeadEncryptionScheme) Decrypt(ct []byte) ([]byte, error) {
+	nonceSize := s.aead.NonceSize()
+	if len(ct) < nonceSize+s.aead.Overhead() {
+		return nil, ErrDecrypt
+	}
+
+	nonce, ciphertext := ct[:nonceSize], ct[nonceSize:]
+	pt, err := s.aead.Open(nil, nonce, ciphertext, nil)
+	if err != nil {
+		return nil, ErrDecrypt
+	}
+
+	return pt, nil
+}
+
+// newAESGCM256EncryptionScheme builds the "aes-gcm-256" EncryptionScheme.
+func newAESGCM256EncryptionScheme(key []byte) (EncryptionScheme, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	return &aeadEncryptionScheme{aead: gcm}, nil
+}
+
+// newChaCha20Poly1305EncryptionScheme builds the "chacha20poly1305"
+// EncryptionScheme.
+func newChaCha20Poly1305EncryptionScheme(key []byte) (EncryptionScheme, error) {
+	aead, err := chacha20poly1305.New(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return &aeadEncryptionScheme{aead: aead}, nil
+}
+
+// Private Methods
+
+// marshalWithoutSignature clones tx, clears its Signature field and
+// marshals the result, leaving the original tx untouched.
+func marshalWithoutSignature(tx *obc.Transaction) ([]byte, error) {
+	clone := proto.Clone(tx).(*obc.Transaction)
+	clone.Signature = nil
+
+	return proto.Marshal(clone)
+}
+
+// cachedCertFromDER parses der into an *x509.Certificate, reusing the
+// result of a previous call with the same DER bytes. Parsed certificates
+// are cached in certByDERHash, keyed by the SHA3-384 hash of der, under
+// certByDERHashLock so concurrent callers (e.g. BatchPreValidation) never
+// race on the map.
+func (validator *Validator) cachedCertFromDER(der []byte) (*x509.Certificate, error) {
+	key := string(primitives.Hash(der))
+
+	validator.certByDERHashLock.RLock()
+	cert, ok := validator.certByDERHash[key]
+	validator.certByDERHashLock.RUnlock()
+	if ok {
+		return cert, nil
+	}
+
+	cert, err := utils.DERToX509Certificate(der)
+	if err != nil {
+		return nil, err
+	}
+
+	validator.certByDERHashLock.Lock()
+	if validator.certByDERHash == nil {
+		validator.certByDERHash = make(map[string]*x509.Certificate)
+	}
+	validator.certByDERHash[key] = cert
+	validator.certByDERHashLock.Unlock()
+
+	return cert, nil
+}
+
+// canDecryptTx probes whether this validator is able to decrypt tx's
+// confidential payload, without mutating tx. It returns
+// ErrConfidentialityKeyMissing when the validator does not hold the
+// enrollment chain key for tx's confidentiality group, and
+// ErrConfidentialPayloadTampered when the ciphertext fails AEAD
+// verification.
+func (validator *Validator) canDecryptTx(tx *obc.Transaction) error {
+	if len(validator.enrollChainKey) == 0 {
+		return ErrConfidentialityKeyMissing
+	}
+
+	scheme, err := newEncryptionScheme(tx.SchemeId, validator.enrollChainKey)
+	if err != nil {
+		log.Error("Failed resolving encryption scheme [%s]: %s", tx.SchemeId, err)
+		return ErrConfidentialPayloadTampered
+	}
+
+	clone := proto.Clone(tx).(*obc.Transaction)
+	if err := validator.decryptTxWithScheme(clone, scheme); err != nil {
+		log.Error("Failed probing tx decryption: %s", err)
+		return ErrConfidentialPayloadTampered
+	}
+
+	return nil
+}
+
+// decryptTxWithScheme decrypts tx's confidential payload and chaincode ID
+// in place using scheme, replacing EncryptedPayload/EncryptedChaincodeID
+// with Payload/ChaincodeID. It supersedes the legacy decryptTx, which
+// always decrypted with whatever cipher the validator was hardwired to
+// rather than the scheme tx itself declares via SchemeId.
+func (validator *Validator) decryptTxWithScheme(tx *obc.Transaction, scheme EncryptionScheme) error {
+	payload, err := scheme.Decrypt(tx.EncryptedPayload)
+	if err != nil {
+		return err
+	}
+
+	chaincodeID, err := scheme.Decrypt(tx.EncryptedChaincodeID)
+	if err != nil {
+		return err
+	}
+
+	tx.Payload = payload
+	tx.ChaincodeID = chaincodeID
+
+	return nil
+}
+
+// certPoolFromDER parses a chain of DER-encoded certificates and returns
+// a pool containing all of them, suitable as a checkCertAgainstRoot trust
+// anchor.
+func certPoolFromDER(chain [][]byte) (*x509.CertPool, error) {
+	pool := x509.NewCertPool()
+	for _, der := range chain {
+		cert, err := x509.ParseCertificate(der)
+		if err != nil {
+			return nil, err
+		}
+		pool.AddCert(cert)
+	}
+
+	return pool, nil
+}
+
+// checkCertAgainstRoot verifies cert against the given pool of trusted
+// roots. TCerts/ECerts carry critical Fabric-specific extensions the
+// stdlib x509 package does not recognize, so they are cleared on a copy
+// of cert before calling Verify: cert may be a *x509.Certificate shared
+// across concurrent callers (see cachedCertFromDER), and mutating it in
+// place would race.
+func checkCertAgainstRoot(cert *x509.Certificate, pool *x509.CertPool) error {
+	certCopy := *cert
+	certCopy.UnhandledCriticalExtensions = nil
+
+	opts := x509.VerifyOptions{
+		Roots:     pool,
+		KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	}
+
+	if _, err := certCopy.Verify(opts); err != nil {
+		return err
+	}
+
+	return nil
+}
+
 // Public Methods
 
 // Register is used to register this validator to the membership service.
@@ -105,12 +383,28 @@ func (validator *Validator) Register(userId, pwd string) error {
 		return err
 	}
 
+	ecaCertPool, err := certPoolFromDER(validator.ecaCertsChain)
+	if err != nil {
+		log.Error("Failed building ECA cert pool:: %s", err)
+
+		return err
+	}
+	validator.ecaCertPool = ecaCertPool
+
 	if err := validator.retrieveTCACertsChain(userId); err != nil {
 		log.Error("Failed retrieveing ECA certs chain:: %s", err)
 
 		return err
 	}
 
+	tcaCertPool, err := certPoolFromDER(validator.tcaCertsChain)
+	if err != nil {
+		log.Error("Failed building TCA cert pool:: %s", err)
+
+		return err
+	}
+	validator.tcaCertPool = tcaCertPool
+
 	if err := validator.retrieveEnrollmentData(userId, pwd); err != nil {
 		log.Error("Failed retrieveing enrollment data:: %s", err)
 
@@ -139,6 +433,10 @@ func (validator *Validator) Init() error {
 		return err
 	}
 
+	// Strict confidentiality defaults to false so validators that
+	// intentionally forward opaque confidential txs keep working.
+	validator.strictConfidentiality = viper.GetBool("validator.confidentiality.strict")
+
 	// Initialize DB
 	log.Info("Init DB...")
 	err := initDB()
@@ -182,6 +480,21 @@ func (validator *Validator) GetEnrollmentID() string {
 	return validator.enrollId
 }
 
+// TransactionID returns a stable identifier for tx: the hash of tx
+// marshalled with its Signature field cleared. The identifier is
+// therefore invariant across re-signing and stable across proto
+// round-trips, so consensus code can key on it rather than on payload
+// fields.
+func (validator *Validator) TransactionID(tx *obc.Transaction) ([]byte, error) {
+	raw, err := marshalWithoutSignature(tx)
+	if err != nil {
+		log.Error("Failed marshaling tx: %s", err)
+		return nil, err
+	}
+
+	return primitives.Hash(raw), nil
+}
+
 // TransactionPreValidation verifies that the transaction is
 // well formed with the respect to the security layer
 // prescriptions (i.e. signature verification).
@@ -197,22 +510,26 @@ func (validator *Validator) TransactionPreValidation(tx *obc.Transaction) (*obc.
 
 		// Verify the transaction
 		// 1. Unmarshal cert
-		cert, err := utils.DERToX509Certificate(tx.Cert)
+		cert, err := validator.cachedCertFromDER(tx.Cert)
 		if err != nil {
 			log.Error("Failed unmarshalling cert: %s", err)
 			return tx, err
 		}
-		// TODO: verify cert
+		// Verify the tx cert against the TCA roots, falling back to the
+		// ECA roots (TCerts and ECerts are both accepted here).
+		if err := checkCertAgainstRoot(cert, validator.tcaCertPool); err != nil {
+			if err := checkCertAgainstRoot(cert, validator.ecaCertPool); err != nil {
+				log.Error("Failed verifying tx cert against trusted roots: %s", err)
+				return tx, ErrUntrustedTransactionCert
+			}
+		}
 
 		// 3. Marshall tx without signature
-		signature := tx.Signature
-		tx.Signature = nil
-		rawTx, err := proto.Marshal(tx)
+		rawTx, err := marshalWithoutSignature(tx)
 		if err != nil {
 			log.Error("Failed marshaling tx %s:", err)
 			return tx, err
 		}
-		tx.Signature = signature
 
 		// 2. Verify signature
 		ok, err := validator.verify(cert.PublicKey, rawTx, tx.Signature)
@@ -240,7 +557,16 @@ func (validator *Validator) TransactionPreValidation(tx *obc.Transaction) (*obc.
 				return nil, ErrInvalidEncryptedChaincodeIDNilOrEmpty
 			}
 
-			// TODO: shall we try to decrypt?
+			// Probe decryption so consensus can drop a tx early rather
+			// than carry one that cannot, or should not, be executed.
+			if err := validator.canDecryptTx(tx); err != nil {
+				if err == ErrConfidentialityKeyMissing && !validator.strictConfidentiality {
+					log.Warning("Validator is not a member of this tx's confidentiality group, forwarding opaque tx")
+					break
+				}
+
+				return nil, err
+			}
 		}
 	} else {
 		if tx.Cert == nil {
@@ -255,6 +581,46 @@ func (validator *Validator) TransactionPreValidation(tx *obc.Transaction) (*obc.
 	return tx, nil
 }
 
+// BatchPreValidation runs TransactionPreValidation over txs concurrently,
+// fanning work out across a worker pool sized to GOMAXPROCS. Results
+// preserve input order: the i-th entry of each returned slice corresponds
+// to txs[i], so a single bad tx in the batch does not abort the rest.
+// Parsed certificates are shared across workers via cachedCertFromDER, so
+// a block with repeated senders only pays the parse cost once per sender.
+func (validator *Validator) BatchPreValidation(txs []*obc.Transaction) ([]*obc.Transaction, []error) {
+	results := make([]*obc.Transaction, len(txs))
+	errs := make([]error, len(txs))
+
+	workers := runtime.GOMAXPROCS(0)
+	if workers > len(txs) {
+		workers = len(txs)
+	}
+	if workers < 1 {
+		workers = 1
+	}
+
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	wg.Add(workers)
+	for w := 0; w < workers; w++ {
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				results[i], errs[i] = validator.TransactionPreValidation(txs[i])
+			}
+		}()
+	}
+
+	for i := range txs {
+		jobs <- i
+	}
+	close(jobs)
+
+	wg.Wait()
+
+	return results, errs
+}
+
 // TransactionPreValidation verifies that the transaction is
 // well formed with the respect to the security layer
 // prescriptions (i.e. signature verification). If this is the case,
@@ -264,15 +630,37 @@ func (validator *Validator) TransactionPreExecution(tx *obc.Transaction) (*obc.T
 		return nil, ErrModuleNotInitialized
 	}
 
+	if tx.Cert != nil {
+		cert, err := utils.DERToX509Certificate(tx.Cert)
+		if err != nil {
+			log.Error("Failed unmarshalling tx cert: %s", err)
+			return nil, err
+		}
+
+		attrs, err := validator.TCertAttributes(cert)
+		if err != nil {
+			log.Error("Failed extracting attributes from tx cert: %s", err)
+			return nil, err
+		}
+		tx.Attributes = attrs
+	}
+
 	switch tx.ConfidentialityLevel {
 	case obc.Transaction_CHAINCODE_PUBLIC:
 		// TODO: Nothing to do here?
 
 		break
 	case obc.Transaction_CHAINCODE_CONFIDENTIAL:
-		// Decrypt payload
-		err := validator.decryptTx(tx)
+		scheme, err := newEncryptionScheme(tx.SchemeId, validator.enrollChainKey)
 		if err != nil {
+			log.Error("Failed resolving encryption scheme [%s]: %s", tx.SchemeId, err)
+
+			return nil, err
+		}
+
+		// Decrypt payload with the scheme the transaction declares, rather
+		// than whatever decryptTx happens to be hardwired to.
+		if err := validator.decryptTxWithScheme(tx, scheme); err != nil {
 			log.Error("Failed decrypting: %s", err)
 
 			return nil, err
@@ -282,6 +670,100 @@ func (validator *Validator) TransactionPreExecution(tx *obc.Transaction) (*obc.T
 	return tx, nil
 }
 
+// TCertAttributes parses the Fabric TCertAttributesHeaders critical
+// extension carried by cert and returns a map from attribute name to the
+// raw bytes stored in the corresponding per-attribute critical extension.
+// The header is a comma-separated list of "name->position" entries; an
+// empty position means the attribute is declared but carries no value.
+// Duplicate names are resolved to the first occurrence in the header.
+func (validator *Validator) TCertAttributes(cert *x509.Certificate) (map[string][]byte, error) {
+	var header string
+	for _, ext := range cert.Extensions {
+		if ext.Id.Equal(tCertAttributesHeaders) {
+			header = string(ext.Value)
+			break
+		}
+	}
+	if len(header) == 0 {
+		return nil, nil
+	}
+
+	// Index by the OID's trailing arc (the declared position), not by the
+	// order cert.Extensions happens to iterate in: DER does not guarantee
+	// extensions are emitted in ascending OID order.
+	values := make(map[int][]byte)
+	for _, ext := range cert.Extensions {
+		if len(ext.Id) != len(tCertAttributeBase)+1 || !ext.Id[:len(tCertAttributeBase)].Equal(tCertAttributeBase) {
+			continue
+		}
+
+		values[ext.Id[len(tCertAttributeBase)]] = ext.Value
+	}
+
+	attrs := make(map[string][]byte)
+	for _, entry := range strings.Split(header, ",") {
+		entry = strings.TrimSpace(entry)
+		if len(entry) == 0 {
+			continue
+		}
+
+		parts := strings.SplitN(entry, "->", 2)
+		name := parts[0]
+		if _, duplicate := attrs[name]; duplicate {
+			continue
+		}
+
+		if len(parts) != 2 || len(parts[1]) == 0 {
+			attrs[name] = nil
+			continue
+		}
+
+		position, err := strconv.Atoi(parts[1])
+		if err != nil {
+			log.Error("Failed parsing position for attribute [%s]: %s", name, err)
+			return nil, err
+		}
+
+		value, ok := values[position]
+		if position <= 0 || !ok {
+			return nil, fmt.Errorf("attribute [%s] declares position %d but no attribute extension was found at that position", name, position)
+		}
+
+		attrs[name] = value
+	}
+
+	return attrs, nil
+}
+
+// VerifyAttribute checks that tx's certificate carries the attribute name
+// with exactly the value expected. It fails closed: a missing attribute,
+// or any error extracting attributes from the certificate, is reported as
+// a verification failure.
+func (validator *Validator) VerifyAttribute(tx *obc.Transaction, name string, expected []byte) error {
+	cert, err := utils.DERToX509Certificate(tx.Cert)
+	if err != nil {
+		log.Error("Failed unmarshalling tx cert: %s", err)
+		return err
+	}
+
+	attrs, err := validator.TCertAttributes(cert)
+	if err != nil {
+		log.Error("Failed extracting attributes from tx cert: %s", err)
+		return err
+	}
+
+	value, ok := attrs[name]
+	if !ok {
+		return ErrAttributeNotFound
+	}
+
+	if !bytes.Equal(value, expected) {
+		return ErrInvalidAttributeValue
+	}
+
+	return nil
+}
+
 // Sign signs msg with this validator's signing key and outputs
 // the signature if no error occurred.
 func (validator *Validator) Sign(msg []byte) ([]byte, error) {
@@ -295,6 +777,14 @@ func (validator *Validator) Verify(vkID, signature, message []byte) error {
 	cert, err := validator.getEnrollmentCert(vkID)
 	if err != nil {
 		log.Error("Failed getting enrollment cert for [%s]: %s", utils.EncodeBase64(vkID), err)
+		return ErrInvalidSignature
+	}
+
+	if err := checkCertAgainstRoot(cert, validator.tcaCertPool); err != nil {
+		if err := checkCertAgainstRoot(cert, validator.ecaCertPool); err != nil {
+			log.Error("Failed verifying cert for [%s] against trusted roots: %s", utils.EncodeBase64(vkID), err)
+			return ErrUntrustedTransactionCert
+		}
 	}
 
 	vk := cert.PublicKey.(*ecdsa.PublicKey)
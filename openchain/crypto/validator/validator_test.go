@@ -0,0 +1,494 @@
+/*
+Licensed to the Apache Software Foundation (ASF) under one
+or more contributor license agreements.  See the NOTICE file
+distributed with this work for additional information
+regarding copyright ownership.  The ASF licenses this file
+to you under the Apache License, Version 2.0 (the
+"License"); you may not use this file except in compliance
+with the License.  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing,
+software distributed under the License is distributed on an
+"AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations
+under the License.
+*/
+
+package validator
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"math/big"
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/openblockchain/obc-peer/openchain/crypto/primitives"
+	obc "github.com/openblockchain/obc-peer/protos"
+)
+
+// certWithExtensions builds a throwaway self-signed cert carrying
+// extraExtensions, for exercising TCertAttributes without a real TCA.
+func certWithExtensions(t *testing.T, extraExtensions []pkix.Extension) *x509.Certificate {
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("ecdsa.GenerateKey failed: %s", err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:    big.NewInt(1),
+		Subject:         pkix.Name{CommonName: "tcert-attributes-test"},
+		ExtraExtensions: extraExtensions,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &priv.PublicKey, priv)
+	if err != nil {
+		t.Fatalf("x509.CreateCertificate failed: %s", err)
+	}
+
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("x509.ParseCertificate failed: %s", err)
+	}
+
+	return cert
+}
+
+func tCertAttributeExtension(position int, value string) pkix.Extension {
+	return pkix.Extension{
+		Id:    append(append(asn1.ObjectIdentifier{}, tCertAttributeBase...), position),
+		Value: []byte(value),
+	}
+}
+
+func sampleTransaction() *obc.Transaction {
+	return &obc.Transaction{
+		ChaincodeID:          []byte("chaincode-id"),
+		Payload:              []byte("payload"),
+		Cert:                 []byte("cert"),
+		Signature:            []byte("signature"),
+		ConfidentialityLevel: obc.Transaction_CHAINCODE_PUBLIC,
+	}
+}
+
+func TestTransactionIDInvariantAcrossResigning(t *testing.T) {
+	validator := &Validator{}
+
+	tx := sampleTransaction()
+	id, err := validator.TransactionID(tx)
+	if err != nil {
+		t.Fatalf("TransactionID failed: %s", err)
+	}
+
+	tx.Signature = []byte("a completely different signature")
+	idAfterResign, err := validator.TransactionID(tx)
+	if err != nil {
+		t.Fatalf("TransactionID failed after re-signing: %s", err)
+	}
+
+	if !bytes.Equal(id, idAfterResign) {
+		t.Fatalf("TransactionID changed across re-signing: %x != %x", id, idAfterResign)
+	}
+}
+
+func TestTransactionIDStableAcrossProtoRoundTrip(t *testing.T) {
+	validator := &Validator{}
+
+	tx := sampleTransaction()
+	id, err := validator.TransactionID(tx)
+	if err != nil {
+		t.Fatalf("TransactionID failed: %s", err)
+	}
+
+	raw, err := proto.Marshal(tx)
+	if err != nil {
+		t.Fatalf("proto.Marshal failed: %s", err)
+	}
+
+	roundTripped := &obc.Transaction{}
+	if err := proto.Unmarshal(raw, roundTripped); err != nil {
+		t.Fatalf("proto.Unmarshal failed: %s", err)
+	}
+
+	idAfterRoundTrip, err := validator.TransactionID(roundTripped)
+	if err != nil {
+		t.Fatalf("TransactionID failed after round-trip: %s", err)
+	}
+
+	if !bytes.Equal(id, idAfterRoundTrip) {
+		t.Fatalf("TransactionID changed across proto round-trip: %x != %x", id, idAfterRoundTrip)
+	}
+}
+
+// selfSignedCertDER generates a throwaway self-signed ECDSA certificate,
+// returning its DER encoding alongside the signing key.
+func selfSignedCertDER(t testing.TB) ([]byte, *ecdsa.PrivateKey) {
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("ecdsa.GenerateKey failed: %s", err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "benchmark-sender"},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &priv.PublicKey, priv)
+	if err != nil {
+		t.Fatalf("x509.CreateCertificate failed: %s", err)
+	}
+
+	return der, priv
+}
+
+func TestTCertAttributesNoHeader(t *testing.T) {
+	validator := &Validator{}
+	cert := certWithExtensions(t, nil)
+
+	attrs, err := validator.TCertAttributes(cert)
+	if err != nil {
+		t.Fatalf("TCertAttributes failed: %s", err)
+	}
+	if attrs != nil {
+		t.Fatalf("expected nil attrs for a cert with no attribute header, got %v", attrs)
+	}
+}
+
+func TestTCertAttributesOutOfOrderAndDuplicate(t *testing.T) {
+	validator := &Validator{}
+
+	header := pkix.Extension{Id: tCertAttributesHeaders, Value: []byte("b->2,a->1,a->99")}
+	// Value extensions are added out of ascending OID order on purpose:
+	// TCertAttributes must index by OID arc, not append order.
+	cert := certWithExtensions(t, []pkix.Extension{
+		header,
+		tCertAttributeExtension(2, "value-b"),
+		tCertAttributeExtension(1, "value-a"),
+	})
+
+	attrs, err := validator.TCertAttributes(cert)
+	if err != nil {
+		t.Fatalf("TCertAttributes failed: %s", err)
+	}
+
+	if string(attrs["a"]) != "value-a" {
+		t.Fatalf("expected attrs[a] = value-a, got %q", attrs["a"])
+	}
+	if string(attrs["b"]) != "value-b" {
+		t.Fatalf("expected attrs[b] = value-b, got %q", attrs["b"])
+	}
+}
+
+func TestTCertAttributesEmptyPosition(t *testing.T) {
+	validator := &Validator{}
+
+	header := pkix.Extension{Id: tCertAttributesHeaders, Value: []byte("pub->")}
+	cert := certWithExtensions(t, []pkix.Extension{header})
+
+	attrs, err := validator.TCertAttributes(cert)
+	if err != nil {
+		t.Fatalf("TCertAttributes failed: %s", err)
+	}
+	if value, ok := attrs["pub"]; !ok || value != nil {
+		t.Fatalf("expected attrs[pub] = nil, got %q (present=%v)", value, ok)
+	}
+}
+
+func TestTCertAttributesMissingPosition(t *testing.T) {
+	validator := &Validator{}
+
+	header := pkix.Extension{Id: tCertAttributesHeaders, Value: []byte("missing->5")}
+	cert := certWithExtensions(t, []pkix.Extension{header})
+
+	if _, err := validator.TCertAttributes(cert); err == nil {
+		t.Fatal("expected an error for a declared position with no matching attribute extension")
+	}
+}
+
+func TestAESGCM256EncryptionSchemeRoundTrip(t *testing.T) {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		t.Fatalf("rand.Read failed: %s", err)
+	}
+
+	scheme, err := newEncryptionScheme("aes-gcm-256", key)
+	if err != nil {
+		t.Fatalf("newEncryptionScheme failed: %s", err)
+	}
+
+	ct, err := scheme.Encrypt([]byte("hello"))
+	if err != nil {
+		t.Fatalf("Encrypt failed: %s", err)
+	}
+
+	pt, err := scheme.Decrypt(ct)
+	if err != nil {
+		t.Fatalf("Decrypt failed: %s", err)
+	}
+	if string(pt) != "hello" {
+		t.Fatalf("expected %q, got %q", "hello", pt)
+	}
+}
+
+func TestChaCha20Poly1305EncryptionSchemeRoundTrip(t *testing.T) {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		t.Fatalf("rand.Read failed: %s", err)
+	}
+
+	scheme, err := newEncryptionScheme("chacha20poly1305", key)
+	if err != nil {
+		t.Fatalf("newEncryptionScheme failed: %s", err)
+	}
+
+	ct, err := scheme.Encrypt([]byte("hello"))
+	if err != nil {
+		t.Fatalf("Encrypt failed: %s", err)
+	}
+
+	pt, err := scheme.Decrypt(ct)
+	if err != nil {
+		t.Fatalf("Decrypt failed: %s", err)
+	}
+	if string(pt) != "hello" {
+		t.Fatalf("expected %q, got %q", "hello", pt)
+	}
+}
+
+func TestAEADEncryptionSchemeRejectsShortCiphertext(t *testing.T) {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		t.Fatalf("rand.Read failed: %s", err)
+	}
+
+	scheme, err := newEncryptionScheme("aes-gcm-256", key)
+	if err != nil {
+		t.Fatalf("newEncryptionScheme failed: %s", err)
+	}
+
+	if _, err := scheme.Decrypt([]byte("too short")); err != ErrDecrypt {
+		t.Fatalf("expected ErrDecrypt for a ciphertext shorter than nonce+tag, got %v", err)
+	}
+}
+
+func TestNewEncryptionSchemeUnknown(t *testing.T) {
+	if _, err := newEncryptionScheme("does-not-exist", make([]byte, 32)); err != ErrUnknownEncryptionScheme {
+		t.Fatalf("expected ErrUnknownEncryptionScheme, got %v", err)
+	}
+}
+
+func TestCanDecryptTxMissingKey(t *testing.T) {
+	validator := &Validator{}
+
+	tx := &obc.Transaction{ConfidentialityLevel: obc.Transaction_CHAINCODE_CONFIDENTIAL}
+	if err := validator.canDecryptTx(tx); err != ErrConfidentialityKeyMissing {
+		t.Fatalf("expected ErrConfidentialityKeyMissing, got %v", err)
+	}
+}
+
+func TestCanDecryptTxRoundTrip(t *testing.T) {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		t.Fatalf("rand.Read failed: %s", err)
+	}
+
+	validator := &Validator{enrollChainKey: key}
+
+	scheme, err := newEncryptionScheme("aes-gcm-256", key)
+	if err != nil {
+		t.Fatalf("newEncryptionScheme failed: %s", err)
+	}
+
+	encryptedPayload, err := scheme.Encrypt([]byte("payload"))
+	if err != nil {
+		t.Fatalf("Encrypt failed: %s", err)
+	}
+	encryptedChaincodeID, err := scheme.Encrypt([]byte("chaincode-id"))
+	if err != nil {
+		t.Fatalf("Encrypt failed: %s", err)
+	}
+
+	tx := &obc.Transaction{
+		ConfidentialityLevel: obc.Transaction_CHAINCODE_CONFIDENTIAL,
+		SchemeId:             "aes-gcm-256",
+		EncryptedPayload:     encryptedPayload,
+		EncryptedChaincodeID: encryptedChaincodeID,
+	}
+
+	if err := validator.canDecryptTx(tx); err != nil {
+		t.Fatalf("canDecryptTx failed on a validly encrypted tx: %s", err)
+	}
+
+	// canDecryptTx must not mutate tx: it only probes.
+	if tx.Payload != nil || tx.ChaincodeID != nil {
+		t.Fatal("canDecryptTx mutated tx in place")
+	}
+}
+
+func TestCanDecryptTxTamperedCiphertext(t *testing.T) {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		t.Fatalf("rand.Read failed: %s", err)
+	}
+
+	validator := &Validator{enrollChainKey: key}
+
+	scheme, err := newEncryptionScheme("aes-gcm-256", key)
+	if err != nil {
+		t.Fatalf("newEncryptionScheme failed: %s", err)
+	}
+
+	encryptedPayload, err := scheme.Encrypt([]byte("payload"))
+	if err != nil {
+		t.Fatalf("Encrypt failed: %s", err)
+	}
+	encryptedPayload[len(encryptedPayload)-1] ^= 0xFF
+
+	tx := &obc.Transaction{
+		ConfidentialityLevel: obc.Transaction_CHAINCODE_CONFIDENTIAL,
+		SchemeId:             "aes-gcm-256",
+		EncryptedPayload:     encryptedPayload,
+		EncryptedChaincodeID: encryptedPayload,
+	}
+
+	if err := validator.canDecryptTx(tx); err != ErrConfidentialPayloadTampered {
+		t.Fatalf("expected ErrConfidentialPayloadTampered, got %v", err)
+	}
+}
+
+func TestCheckCertAgainstRootTrusted(t *testing.T) {
+	der, _ := selfSignedCertDER(t)
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("x509.ParseCertificate failed: %s", err)
+	}
+
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+
+	if err := checkCertAgainstRoot(cert, pool); err != nil {
+		t.Fatalf("checkCertAgainstRoot failed against a pool containing the cert itself: %s", err)
+	}
+}
+
+func TestCheckCertAgainstRootUntrusted(t *testing.T) {
+	der, _ := selfSignedCertDER(t)
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("x509.ParseCertificate failed: %s", err)
+	}
+
+	otherDER, _ := selfSignedCertDER(t)
+	otherCert, err := x509.ParseCertificate(otherDER)
+	if err != nil {
+		t.Fatalf("x509.ParseCertificate failed: %s", err)
+	}
+
+	pool := x509.NewCertPool()
+	pool.AddCert(otherCert)
+
+	if err := checkCertAgainstRoot(cert, pool); err == nil {
+		t.Fatal("expected checkCertAgainstRoot to reject a cert not chained to the pool")
+	}
+}
+
+// TestCheckCertAgainstRootTCAMissECAHit checks the two checkCertAgainstRoot
+// outcomes that the TCA-then-ECA fallback in TransactionPreValidation and
+// Verify is built on: a cert is rejected by a TCA pool that lacks it and
+// accepted by an ECA pool that holds it. The fallback itself is not called.
+func TestCheckCertAgainstRootTCAMissECAHit(t *testing.T) {
+	der, _ := selfSignedCertDER(t)
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("x509.ParseCertificate failed: %s", err)
+	}
+
+	emptyPool := x509.NewCertPool()
+	ecaPool := x509.NewCertPool()
+	ecaPool.AddCert(cert)
+
+	if err := checkCertAgainstRoot(cert, emptyPool); err == nil {
+		t.Fatal("expected checkCertAgainstRoot to reject the cert against an empty TCA pool")
+	}
+	if err := checkCertAgainstRoot(cert, ecaPool); err != nil {
+		t.Fatalf("expected checkCertAgainstRoot to accept the cert against the ECA pool: %s", err)
+	}
+}
+
+// BenchmarkBatchPreValidation measures BatchPreValidation fanning a
+// 1k-tx block, signed by a handful of repeated senders, across a worker
+// pool. Repeated senders let cachedCertFromDER pay the parse cost once
+// per sender rather than once per tx.
+func BenchmarkBatchPreValidation(b *testing.B) {
+	const (
+		blockSize  = 1000
+		numSenders = 16
+	)
+
+	senderCertDER := make([][]byte, numSenders)
+	senderKey := make([]*ecdsa.PrivateKey, numSenders)
+	ecaChain := make([][]byte, numSenders)
+	for i := 0; i < numSenders; i++ {
+		senderCertDER[i], senderKey[i] = selfSignedCertDER(b)
+		ecaChain[i] = senderCertDER[i]
+	}
+
+	ecaCertPool, err := certPoolFromDER(ecaChain)
+	if err != nil {
+		b.Fatalf("certPoolFromDER failed: %s", err)
+	}
+
+	txs := make([]*obc.Transaction, blockSize)
+	for i := 0; i < blockSize; i++ {
+		sender := i % numSenders
+
+		tx := &obc.Transaction{
+			ChaincodeID:          []byte("chaincode-id"),
+			Payload:              []byte("payload"),
+			Cert:                 senderCertDER[sender],
+			ConfidentialityLevel: obc.Transaction_CHAINCODE_PUBLIC,
+		}
+
+		rawTx, err := marshalWithoutSignature(tx)
+		if err != nil {
+			b.Fatalf("marshalWithoutSignature failed: %s", err)
+		}
+
+		r, s, err := ecdsa.Sign(rand.Reader, senderKey[sender], primitives.Hash(rawTx))
+		if err != nil {
+			b.Fatalf("ecdsa.Sign failed: %s", err)
+		}
+		signature, err := asn1.Marshal(ecdsaSignature{R: r, S: s})
+		if err != nil {
+			b.Fatalf("asn1.Marshal failed: %s", err)
+		}
+		tx.Signature = signature
+
+		txs[i] = tx
+	}
+
+	validator := &Validator{
+		isInitialized: true,
+		ecaCertPool:   ecaCertPool,
+		tcaCertPool:   ecaCertPool,
+	}
+
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		validator.BatchPreValidation(txs)
+	}
+}
+
+// ecdsaSignature mirrors the ASN.1 encoding ecdsa signatures are carried
+// in throughout this package.
+type ecdsaSignature struct {
+	R, S *big.Int
+}
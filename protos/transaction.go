@@ -0,0 +1,60 @@
+/*
+Licensed to the Apache Software Foundation (ASF) under one
+or more contributor license agreements.  See the NOTICE file
+distributed with this work for additional information
+regarding copyright ownership.  The ASF licenses this file
+to you under the Apache License, Version 2.0 (the
+"License"); you may not use this file except in compliance
+with the License.  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing,
+software distributed under the License is distributed on an
+"AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations
+under the License.
+*/
+
+package protos
+
+// Transaction_ConfidentialityLevel indicates whether a transaction's
+// payload and chaincode ID travel in the clear or encrypted for a
+// confidentiality group.
+type Transaction_ConfidentialityLevel int32
+
+const (
+	Transaction_CHAINCODE_PUBLIC       Transaction_ConfidentialityLevel = 0
+	Transaction_CHAINCODE_CONFIDENTIAL Transaction_ConfidentialityLevel = 1
+)
+
+// Transaction is a single state-changing or query request submitted to
+// the network, together with the security metadata the crypto layer
+// needs to validate and, if confidential, decrypt it.
+type Transaction struct {
+	ChaincodeID []byte `protobuf:"bytes,2,opt,name=chaincodeID,proto3" json:"chaincodeID,omitempty"`
+	Payload     []byte `protobuf:"bytes,3,opt,name=payload,proto3" json:"payload,omitempty"`
+
+	Cert      []byte `protobuf:"bytes,7,opt,name=cert,proto3" json:"cert,omitempty"`
+	Signature []byte `protobuf:"bytes,8,opt,name=signature,proto3" json:"signature,omitempty"`
+
+	ConfidentialityLevel Transaction_ConfidentialityLevel `protobuf:"varint,9,opt,name=confidentialityLevel,proto3,enum=protos.Transaction_ConfidentialityLevel" json:"confidentialityLevel,omitempty"`
+
+	EncryptedChaincodeID []byte `protobuf:"bytes,12,opt,name=encryptedChaincodeID,proto3" json:"encryptedChaincodeID,omitempty"`
+	EncryptedPayload     []byte `protobuf:"bytes,13,opt,name=encryptedPayload,proto3" json:"encryptedPayload,omitempty"`
+
+	// Attributes holds the TCert attribute values decoded from Cert by
+	// Validator.TCertAttributes, keyed by attribute name.
+	Attributes map[string][]byte `protobuf:"bytes,14,rep,name=attributes" json:"attributes,omitempty"`
+
+	// SchemeId names the EncryptionScheme used to produce
+	// EncryptedChaincodeID/EncryptedPayload, e.g. "aes-gcm-256" or
+	// "chacha20poly1305". Ignored when ConfidentialityLevel is
+	// CHAINCODE_PUBLIC.
+	SchemeId string `protobuf:"bytes,15,opt,name=schemeId,proto3" json:"schemeId,omitempty"`
+}
+
+func (tx *Transaction) Reset()         { *tx = Transaction{} }
+func (tx *Transaction) String() string { return "" }
+func (tx *Transaction) ProtoMessage()  {}